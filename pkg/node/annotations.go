@@ -0,0 +1,204 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/cilium/cilium/pkg/cidr"
+	"github.com/cilium/cilium/pkg/node/addressing"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Well-known annotations that let operators override or supplement the
+// CiliumNode/k8s Node Spec without editing CRDs. The legacy
+// "io.cilium.network.*" keys are kept for backwards compatibility with
+// existing clusters; new integrations should prefer the "network.cilium.io/*"
+// form. Any other "*.cilium.io/*" key is ignored by ParseNodeFromAnnotations
+// but reserved for future use.
+const (
+	AnnotationV4CIDRName    = "io.cilium.network.ipv4-pod-cidr"
+	AnnotationV6CIDRName    = "io.cilium.network.ipv6-pod-cidr"
+	AnnotationV4CIDRNameAlt = "network.cilium.io/ipv4-pod-cidr"
+	AnnotationV6CIDRNameAlt = "network.cilium.io/ipv6-pod-cidr"
+
+	AnnotationCiliumHostIP   = "io.cilium.network.ipv4-cilium-host"
+	AnnotationCiliumHostIPv6 = "io.cilium.network.ipv6-cilium-host"
+
+	AnnotationV4HealthName = "network.cilium.io/ipv4-health-ip"
+	AnnotationV6HealthName = "network.cilium.io/ipv6-health-ip"
+
+	AnnotationEncryptionKey = "network.cilium.io/encryption-key"
+	AnnotationWireguardPKey = "network.cilium.io/wg-pubkey"
+)
+
+// FieldError records a single annotation/label value that was present but
+// could not be parsed for the named field, so that one malformed value does
+// not prevent the rest of the Node from being populated.
+type FieldError struct {
+	Field string
+	Value string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: invalid value %q: %s", e.Field, e.Value, e.Err)
+}
+
+// lookup returns the value for key from annotations if present, falling
+// back to labels. Annotations take precedence over labels.
+func lookup(annotations, labels map[string]string, key string) (string, bool) {
+	if v, ok := annotations[key]; ok {
+		return v, true
+	}
+	v, ok := labels[key]
+	return v, ok
+}
+
+// ParseNodeFromAnnotations builds a Node from the well-known annotations
+// (and, as a fallback, labels of the same key) found on meta. It never
+// aborts on a malformed value: the field is left unset and a *FieldError is
+// appended to errs instead.
+func ParseNodeFromAnnotations(meta metav1.ObjectMeta) (n Node, errs []error) {
+	n.Name = meta.Name
+
+	if v, ok := lookup(meta.Annotations, meta.Labels, AnnotationV4CIDRName); ok {
+		n.IPv4AllocCIDR, errs = parseCIDRField("IPv4AllocCIDR", v, errs)
+	}
+	if v, ok := lookup(meta.Annotations, meta.Labels, AnnotationV4CIDRNameAlt); ok && n.IPv4AllocCIDR == nil {
+		n.IPv4AllocCIDR, errs = parseCIDRField("IPv4AllocCIDR", v, errs)
+	}
+	if v, ok := lookup(meta.Annotations, meta.Labels, AnnotationV6CIDRName); ok {
+		n.IPv6AllocCIDR, errs = parseCIDRField("IPv6AllocCIDR", v, errs)
+	}
+	if v, ok := lookup(meta.Annotations, meta.Labels, AnnotationV6CIDRNameAlt); ok && n.IPv6AllocCIDR == nil {
+		n.IPv6AllocCIDR, errs = parseCIDRField("IPv6AllocCIDR", v, errs)
+	}
+
+	if v, ok := lookup(meta.Annotations, meta.Labels, AnnotationCiliumHostIP); ok {
+		n.IPAddresses, errs = appendHostIP(n.IPAddresses, v, errs)
+	}
+	if v, ok := lookup(meta.Annotations, meta.Labels, AnnotationCiliumHostIPv6); ok {
+		n.IPAddresses, errs = appendHostIP(n.IPAddresses, v, errs)
+	}
+
+	if v, ok := lookup(meta.Annotations, meta.Labels, AnnotationV4HealthName); ok {
+		n.IPv4HealthIP, errs = parseIPField("IPv4HealthIP", v, errs)
+	}
+	if v, ok := lookup(meta.Annotations, meta.Labels, AnnotationV6HealthName); ok {
+		n.IPv6HealthIP, errs = parseIPField("IPv6HealthIP", v, errs)
+	}
+
+	if v, ok := lookup(meta.Annotations, meta.Labels, AnnotationEncryptionKey); ok {
+		if key, err := strconv.ParseUint(v, 10, 8); err != nil {
+			errs = append(errs, &FieldError{Field: "EncryptionKey", Value: v, Err: err})
+		} else {
+			n.EncryptionKey = uint8(key)
+		}
+	}
+
+	if v, ok := lookup(meta.Annotations, meta.Labels, AnnotationWireguardPKey); ok {
+		n.WireguardPubKey, errs = parseWireguardPubKeyField(v, errs)
+	}
+
+	return n, errs
+}
+
+func parseCIDRField(field, value string, errs []error) (*cidr.CIDR, []error) {
+	c, err := cidr.ParseCIDR(value)
+	if err != nil {
+		return nil, append(errs, &FieldError{Field: field, Value: value, Err: err})
+	}
+	return c, errs
+}
+
+func parseIPField(field, value string, errs []error) (net.IP, []error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, append(errs, &FieldError{Field: field, Value: value, Err: fmt.Errorf("not a valid IP address")})
+	}
+	return ip, errs
+}
+
+// parseWireguardPubKeyField validates that value is a well-formed
+// base64-encoded WireGuard public key (32 raw bytes) before accepting it.
+func parseWireguardPubKeyField(value string, errs []error) (string, []error) {
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", append(errs, &FieldError{Field: "WireguardPubKey", Value: value, Err: err})
+	}
+	if len(raw) != 32 {
+		return "", append(errs, &FieldError{Field: "WireguardPubKey", Value: value, Err: fmt.Errorf("expected a 32-byte key, got %d bytes", len(raw))})
+	}
+	return value, errs
+}
+
+func appendHostIP(addrs []Address, value string, errs []error) ([]Address, []error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return addrs, append(errs, &FieldError{Field: "IPAddresses", Value: value, Err: fmt.Errorf("not a valid IP address")})
+	}
+	return append(addrs, Address{Type: addressing.NodeCiliumInternalIP, IP: ip}), errs
+}
+
+// mergeAnnotations overlays onto base every field that base left unset,
+// taking its values from annotations/labels-derived overlay. Spec (base)
+// always wins over annotation/label (overlay) when both are present. For
+// IPAddresses, an overlay address is added only if base has no address of
+// the same Type and address family.
+func mergeAnnotations(base Node, overlay Node) Node {
+	if base.IPv4AllocCIDR == nil {
+		base.IPv4AllocCIDR = overlay.IPv4AllocCIDR
+	}
+	if base.IPv6AllocCIDR == nil {
+		base.IPv6AllocCIDR = overlay.IPv6AllocCIDR
+	}
+	if base.IPv4HealthIP == nil {
+		base.IPv4HealthIP = overlay.IPv4HealthIP
+	}
+	if base.IPv6HealthIP == nil {
+		base.IPv6HealthIP = overlay.IPv6HealthIP
+	}
+	if base.EncryptionKey == 0 {
+		base.EncryptionKey = overlay.EncryptionKey
+	}
+	if base.WireguardPubKey == "" {
+		base.WireguardPubKey = overlay.WireguardPubKey
+	}
+
+	// Key on the address Type and family, so that a Spec address of a given
+	// type and family is never joined by an annotation-derived one.
+	type addrKey struct {
+		Type addressing.AddressType
+		IPv4 bool
+	}
+	have := make(map[addrKey]struct{}, len(base.IPAddresses))
+	for _, addr := range base.IPAddresses {
+		have[addrKey{addr.Type, addr.IP.To4() != nil}] = struct{}{}
+	}
+	for _, addr := range overlay.IPAddresses {
+		key := addrKey{addr.Type, addr.IP.To4() != nil}
+		if _, ok := have[key]; ok {
+			continue
+		}
+		base.IPAddresses = append(base.IPAddresses, addr)
+		have[key] = struct{}{}
+	}
+
+	return base
+}
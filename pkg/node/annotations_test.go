@@ -0,0 +1,176 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !privileged_tests
+
+package node
+
+import (
+	"encoding/base64"
+	"net"
+
+	"github.com/cilium/cilium/pkg/checker"
+	"github.com/cilium/cilium/pkg/cidr"
+	ciliumv2 "github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+	"github.com/cilium/cilium/pkg/node/addressing"
+	"github.com/cilium/cilium/pkg/source"
+
+	. "gopkg.in/check.v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func (s *NodeSuite) TestParseNodeFromAnnotations(c *C) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		labels      map[string]string
+		want        Node
+		wantErrs    int
+	}{
+		{
+			name: "well-known annotations",
+			annotations: map[string]string{
+				AnnotationV4CIDRName:   "10.1.0.0/16",
+				AnnotationV6CIDRName:   "c0de::/96",
+				AnnotationV4HealthName: "1.1.1.1",
+			},
+			want: Node{
+				Name:          "foo",
+				IPv4AllocCIDR: cidr.MustParseCIDR("10.1.0.0/16"),
+				IPv6AllocCIDR: cidr.MustParseCIDR("c0de::/96"),
+				IPv4HealthIP:  net.ParseIP("1.1.1.1"),
+			},
+		},
+		{
+			name: "label fallback when annotation absent",
+			labels: map[string]string{
+				AnnotationV4CIDRName: "10.2.0.0/16",
+			},
+			want: Node{
+				Name:          "foo",
+				IPv4AllocCIDR: cidr.MustParseCIDR("10.2.0.0/16"),
+			},
+		},
+		{
+			name: "annotation wins over label",
+			annotations: map[string]string{
+				AnnotationV4CIDRName: "10.3.0.0/16",
+			},
+			labels: map[string]string{
+				AnnotationV4CIDRName: "10.4.0.0/16",
+			},
+			want: Node{
+				Name:          "foo",
+				IPv4AllocCIDR: cidr.MustParseCIDR("10.3.0.0/16"),
+			},
+		},
+		{
+			name: "malformed CIDR is skipped, not fatal",
+			annotations: map[string]string{
+				AnnotationV4CIDRName:   "not-a-cidr",
+				AnnotationV4HealthName: "1.1.1.1",
+			},
+			want: Node{
+				Name:         "foo",
+				IPv4HealthIP: net.ParseIP("1.1.1.1"),
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "malformed health IP is skipped, not fatal",
+			annotations: map[string]string{
+				AnnotationV4HealthName: "not-an-ip",
+			},
+			want:     Node{Name: "foo"},
+			wantErrs: 1,
+		},
+		{
+			name: "well-formed WireGuard pubkey",
+			annotations: map[string]string{
+				AnnotationWireguardPKey: base64.StdEncoding.EncodeToString(make([]byte, 32)),
+			},
+			want: Node{
+				Name:            "foo",
+				WireguardPubKey: base64.StdEncoding.EncodeToString(make([]byte, 32)),
+			},
+		},
+		{
+			name: "malformed WireGuard pubkey is skipped, not fatal",
+			annotations: map[string]string{
+				AnnotationWireguardPKey: "not-base64!!",
+			},
+			want:     Node{Name: "foo"},
+			wantErrs: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		c.Logf(tt.name)
+		meta := metav1.ObjectMeta{Name: "foo", Annotations: tt.annotations, Labels: tt.labels}
+		got, errs := ParseNodeFromAnnotations(meta)
+		c.Assert(got, DeepEquals, tt.want)
+		c.Assert(len(errs), Equals, tt.wantErrs)
+	}
+}
+
+// TestParseCiliumNodeAnnotationPrecedence covers the "Spec wins over
+// annotation" rule end-to-end through ParseCiliumNode: the v4 pod CIDR and
+// the encryption key are both set by Spec and contradicted by an
+// annotation, and Spec must win for each; the cilium-host IP is set
+// identically by both Spec and annotation and must not be duplicated in
+// IPAddresses; the v6 health IP is only set by annotation (Spec leaves it
+// unset) and must still be applied.
+func (s *NodeSuite) TestParseCiliumNodeAnnotationPrecedence(c *C) {
+	nodeResource := &ciliumv2.CiliumNode{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+			Annotations: map[string]string{
+				// Conflicts with Spec.IPAM.PodCIDRs below; Spec must win.
+				AnnotationV4CIDRName: "192.168.0.0/16",
+				// Matches the cilium-host address already in Spec.Addresses
+				// below; must not be duplicated.
+				AnnotationCiliumHostIP: "10.1.1.1",
+				// Conflicts with Spec.Encryption.Key below; Spec must win.
+				AnnotationEncryptionKey: "42",
+				// Not present in Spec at all; annotation must still apply.
+				AnnotationV6HealthName: "c0de::1",
+			},
+		},
+		Spec: ciliumv2.NodeSpec{
+			Addresses: []ciliumv2.NodeAddress{
+				{Type: addressing.NodeInternalIP, IP: "2.2.2.2"},
+				{Type: addressing.NodeCiliumInternalIP, IP: "10.1.1.1"},
+			},
+			Encryption: ciliumv2.EncryptionSpec{
+				Key: 7,
+			},
+			IPAM: ciliumv2.IPAMSpec{
+				PodCIDRs: []string{"10.10.0.0/16"},
+			},
+		},
+	}
+
+	n := ParseCiliumNode(nodeResource)
+	c.Assert(n, checker.DeepEquals, Node{
+		Name:          "foo",
+		Source:        source.CustomResource,
+		EncryptionKey: uint8(7),
+		IPv4AllocCIDR: cidr.MustParseCIDR("10.10.0.0/16"),
+		IPv6HealthIP:  net.ParseIP("c0de::1"),
+		IPAddresses: []Address{
+			{Type: addressing.NodeInternalIP, IP: net.ParseIP("2.2.2.2")},
+			{Type: addressing.NodeCiliumInternalIP, IP: net.ParseIP("10.1.1.1")},
+		},
+	})
+}
@@ -0,0 +1,299 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"math/big"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/cilium/cilium/pkg/cidr"
+)
+
+// NodeCIDRAggregator maintains the union of every known node's pod
+// allocation CIDRs (primary and secondary, per AllIPv4AllocCIDRs /
+// AllIPv6AllocCIDRs) as a minimal covering CIDR list per address family:
+// adjacent and overlapping ranges are merged into the smallest possible
+// set of CIDRs, the way Antrea's ServiceCIDRProvider does for Service IPs.
+// This lets the datapath install one encapsulation/route entry per covering
+// CIDR instead of one per node.
+//
+// Per-node CIDRs are retained internally so that removing a node can
+// recompute the covering set precisely, rather than only ever growing it.
+//
+// A change is announced to each subscriber as up to two calls: first
+// fn(added, nil) for every subscriber (if anything was added), then, only
+// once every subscriber's added-call has returned, fn(nil, removed) (if
+// anything was removed). Since fn is called synchronously, a subscriber
+// that installs the added route within its added-call is guaranteed to
+// have done so before being told to retire any route it supersedes.
+type NodeCIDRAggregator struct {
+	mu sync.Mutex
+
+	nodeCIDRsV4 map[string][]*cidr.CIDR
+	nodeCIDRsV6 map[string][]*cidr.CIDR
+
+	v4 map[string]*cidr.CIDR
+	v6 map[string]*cidr.CIDR
+
+	subscribers []func(added, removed []*cidr.CIDR)
+}
+
+// NewNodeCIDRAggregator returns an empty NodeCIDRAggregator.
+func NewNodeCIDRAggregator() *NodeCIDRAggregator {
+	return &NodeCIDRAggregator{
+		nodeCIDRsV4: map[string][]*cidr.CIDR{},
+		nodeCIDRsV6: map[string][]*cidr.CIDR{},
+		v4:          map[string]*cidr.CIDR{},
+		v6:          map[string]*cidr.CIDR{},
+	}
+}
+
+// nodeKey identifies a node across clusters, matching the convention used
+// by pkg/node/table's ClusterNameIndex.
+func nodeKey(n *Node) string {
+	return n.Cluster + "/" + n.Name
+}
+
+// Get returns the current minimal covering CIDR list across both address
+// families. Callers must not mutate the returned CIDRs.
+func (a *NodeCIDRAggregator) Get() []*cidr.CIDR {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	all := make([]*cidr.CIDR, 0, len(a.v4)+len(a.v6))
+	for _, c := range a.v4 {
+		all = append(all, c)
+	}
+	for _, c := range a.v6 {
+		all = append(all, c)
+	}
+	return all
+}
+
+// Subscribe registers fn to be called whenever the covering set changes.
+// See the NodeCIDRAggregator doc comment for the exact calling convention.
+func (a *NodeCIDRAggregator) Subscribe(fn func(added, removed []*cidr.CIDR)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.subscribers = append(a.subscribers, fn)
+}
+
+// AddNode records n's allocation CIDRs (replacing any previously recorded
+// for the same node) and notifies subscribers of the resulting change to
+// the covering set, if any.
+func (a *NodeCIDRAggregator) AddNode(n *Node) {
+	key := nodeKey(n)
+
+	a.mu.Lock()
+	a.nodeCIDRsV4[key] = n.AllIPv4AllocCIDRs()
+	a.nodeCIDRsV6[key] = n.AllIPv6AllocCIDRs()
+	a.recomputeAndNotifyLocked()
+}
+
+// RemoveNode forgets n's allocation CIDRs and notifies subscribers of the
+// resulting change to the covering set, if any. Removing a CIDR whose
+// addresses are all still covered by the CIDRs of other still-present
+// nodes is a no-op, since that CIDR's coverage is still required.
+func (a *NodeCIDRAggregator) RemoveNode(n *Node) {
+	key := nodeKey(n)
+
+	a.mu.Lock()
+	delete(a.nodeCIDRsV4, key)
+	delete(a.nodeCIDRsV6, key)
+	a.recomputeAndNotifyLocked()
+}
+
+// Reconcile replaces the full set of tracked nodes and notifies subscribers
+// of the resulting change to the covering set, if any.
+func (a *NodeCIDRAggregator) Reconcile(nodes []*Node) {
+	a.mu.Lock()
+	a.nodeCIDRsV4 = make(map[string][]*cidr.CIDR, len(nodes))
+	a.nodeCIDRsV6 = make(map[string][]*cidr.CIDR, len(nodes))
+	for _, n := range nodes {
+		key := nodeKey(n)
+		a.nodeCIDRsV4[key] = n.AllIPv4AllocCIDRs()
+		a.nodeCIDRsV6[key] = n.AllIPv6AllocCIDRs()
+	}
+	a.recomputeAndNotifyLocked()
+}
+
+// recomputeAndNotifyLocked recomputes the minimal covering set from the
+// currently tracked per-node CIDRs, updates a.v4/a.v6, and notifies
+// subscribers. Callers must hold a.mu; it is released before returning.
+func (a *NodeCIDRAggregator) recomputeAndNotifyLocked() {
+	var v4, v6 []*cidr.CIDR
+	for _, cidrs := range a.nodeCIDRsV4 {
+		v4 = append(v4, cidrs...)
+	}
+	for _, cidrs := range a.nodeCIDRsV6 {
+		v6 = append(v6, cidrs...)
+	}
+
+	newV4 := minimalCover(v4, 32)
+	newV6 := minimalCover(v6, 128)
+
+	added, removed := diffCIDRSets(a.v4, newV4)
+	addedV6, removedV6 := diffCIDRSets(a.v6, newV6)
+	added = append(added, addedV6...)
+	removed = append(removed, removedV6...)
+
+	a.v4, a.v6 = newV4, newV6
+	subs := append([]func(added, removed []*cidr.CIDR){}, a.subscribers...)
+	a.mu.Unlock()
+
+	if len(added) > 0 {
+		for _, fn := range subs {
+			fn(added, nil)
+		}
+	}
+	if len(removed) > 0 {
+		for _, fn := range subs {
+			fn(nil, removed)
+		}
+	}
+}
+
+// diffCIDRSets returns the CIDRs present in newSet but not old (added) and
+// those present in old but not newSet (removed).
+func diffCIDRSets(old, newSet map[string]*cidr.CIDR) (added, removed []*cidr.CIDR) {
+	for key, c := range newSet {
+		if _, ok := old[key]; !ok {
+			added = append(added, c)
+		}
+	}
+	for key, c := range old {
+		if _, ok := newSet[key]; !ok {
+			removed = append(removed, c)
+		}
+	}
+	return
+}
+
+// minimalCover returns the smallest set of CIDRs, keyed by string form,
+// whose union of addresses exactly equals the union of addresses in
+// cidrs. Unlike a simple subset-elimination pass, adjacent CIDRs that
+// together form an aligned supernet (e.g. 10.0.0.0/24 + 10.0.1.0/24 ->
+// 10.0.0.0/23) are merged into that supernet.
+func minimalCover(cidrs []*cidr.CIDR, bits int) map[string]*cidr.CIDR {
+	type ipRange struct{ start, end *big.Int }
+
+	ranges := make([]ipRange, 0, len(cidrs))
+	for _, c := range cidrs {
+		if c == nil {
+			continue
+		}
+		ones, cbits := c.Mask.Size()
+		if cbits != bits {
+			continue
+		}
+		start := ipToBigInt(c.IP, bits)
+		size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+		end := new(big.Int).Sub(new(big.Int).Add(start, size), big.NewInt(1))
+		ranges = append(ranges, ipRange{start, end})
+	}
+	if len(ranges) == 0 {
+		return map[string]*cidr.CIDR{}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Cmp(ranges[j].start) < 0 })
+
+	merged := []ipRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		// Merge if r overlaps or is adjacent to the previous range
+		// (last.end + 1 >= r.start).
+		if new(big.Int).Add(last.end, big.NewInt(1)).Cmp(r.start) >= 0 {
+			if r.end.Cmp(last.end) > 0 {
+				last.end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	result := map[string]*cidr.CIDR{}
+	for _, r := range merged {
+		for _, c := range rangeToCIDRs(r.start, r.end, bits) {
+			result[c.String()] = c
+		}
+	}
+	return result
+}
+
+// rangeToCIDRs covers [start, end] with the minimal number of CIDRs,
+// repeatedly taking the largest block aligned at the current position that
+// still fits within the remaining range.
+func rangeToCIDRs(start, end *big.Int, bits int) []*cidr.CIDR {
+	var result []*cidr.CIDR
+	one := big.NewInt(1)
+	cur := new(big.Int).Set(start)
+
+	for cur.Cmp(end) <= 0 {
+		alignBits := trailingZeroBits(cur, bits)
+
+		remaining := new(big.Int).Sub(end, cur)
+		remaining.Add(remaining, one)
+
+		sizeBits := alignBits
+		for sizeBits > 0 {
+			size := new(big.Int).Lsh(one, uint(sizeBits))
+			if size.Cmp(remaining) <= 0 {
+				break
+			}
+			sizeBits--
+		}
+
+		ones := bits - sizeBits
+		ipNet := &net.IPNet{IP: bigIntToIP(cur, bits), Mask: net.CIDRMask(ones, bits)}
+		result = append(result, cidr.NewCIDR(ipNet))
+
+		cur.Add(cur, new(big.Int).Lsh(one, uint(sizeBits)))
+	}
+	return result
+}
+
+// trailingZeroBits returns the number of trailing zero bits in x, the
+// largest power-of-two block size that can be aligned starting at x,
+// capped at maxBits.
+func trailingZeroBits(x *big.Int, maxBits int) int {
+	for i := 0; i < maxBits; i++ {
+		if x.Bit(i) != 0 {
+			return i
+		}
+	}
+	return maxBits
+}
+
+func ipToBigInt(ip net.IP, bits int) *big.Int {
+	if bits == 32 {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	return new(big.Int).SetBytes(ip)
+}
+
+func bigIntToIP(i *big.Int, bits int) net.IP {
+	byteLen := bits / 8
+	b := i.Bytes()
+	if len(b) < byteLen {
+		padded := make([]byte, byteLen)
+		copy(padded[byteLen-len(b):], b)
+		b = padded
+	}
+	return net.IP(b)
+}
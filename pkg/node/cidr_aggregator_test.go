@@ -0,0 +1,137 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !privileged_tests
+
+package node
+
+import (
+	"github.com/cilium/cilium/pkg/cidr"
+
+	. "gopkg.in/check.v1"
+)
+
+type cidrAggregatorCall struct {
+	added, removed []string
+}
+
+func cidrSet(c *C, agg *NodeCIDRAggregator) []string {
+	var s []string
+	for _, cd := range agg.Get() {
+		s = append(s, cd.String())
+	}
+	return s
+}
+
+func cidrNames(cidrs []*cidr.CIDR) []string {
+	var s []string
+	for _, cd := range cidrs {
+		s = append(s, cd.String())
+	}
+	return s
+}
+
+func (s *NodeSuite) TestNodeCIDRAggregatorDisjointUnion(c *C) {
+	agg := NewNodeCIDRAggregator()
+	agg.AddNode(&Node{Name: "a", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.0.0/24")})
+	agg.AddNode(&Node{Name: "b", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.5.0/24")})
+
+	// Non-adjacent /24s cannot be combined into a single covering CIDR
+	// without including addresses that belong to neither node.
+	c.Assert(cidrSet(c, agg), HasLen, 2)
+}
+
+func (s *NodeSuite) TestNodeCIDRAggregatorSupernetMerge(c *C) {
+	agg := NewNodeCIDRAggregator()
+	agg.AddNode(&Node{Name: "a", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.0.0/24")})
+	agg.AddNode(&Node{Name: "b", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.1.0/24")})
+
+	// Two adjacent, aligned /24s are a minimal covering /23, not two
+	// separate /24 entries.
+	c.Assert(cidrSet(c, agg), DeepEquals, []string{"10.0.0.0/23"})
+}
+
+func (s *NodeSuite) TestNodeCIDRAggregatorSupersede(c *C) {
+	agg := NewNodeCIDRAggregator()
+	agg.AddNode(&Node{Name: "a", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.0.0/24")})
+	agg.AddNode(&Node{Name: "b", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.2.0/24")})
+
+	var calls []cidrAggregatorCall
+	agg.Subscribe(func(added, removed []*cidr.CIDR) {
+		calls = append(calls, cidrAggregatorCall{cidrNames(added), cidrNames(removed)})
+	})
+
+	// A broader CIDR that covers both existing /24s supersedes them: the
+	// broad CIDR must be announced added, in its own call, before the two
+	// narrow CIDRs it supersedes are announced removed.
+	agg.AddNode(&Node{Name: "c", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.0.0/16")})
+
+	c.Assert(calls, HasLen, 2)
+	c.Assert(calls[0].added, DeepEquals, []string{"10.0.0.0/16"})
+	c.Assert(calls[0].removed, HasLen, 0)
+	c.Assert(calls[1].added, HasLen, 0)
+	c.Assert(calls[1].removed, HasLen, 2)
+
+	c.Assert(cidrSet(c, agg), DeepEquals, []string{"10.0.0.0/16"})
+}
+
+func (s *NodeSuite) TestNodeCIDRAggregatorNoSpuriousNotify(c *C) {
+	agg := NewNodeCIDRAggregator()
+	calls := 0
+	agg.Subscribe(func(a, r []*cidr.CIDR) { calls++ })
+
+	agg.AddNode(&Node{Name: "a", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.0.0/24")})
+	// Re-adding the same CIDR (e.g. from another node sharing it) must
+	// not trigger a spurious notification.
+	agg.AddNode(&Node{Name: "b", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.0.0/24")})
+
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *NodeSuite) TestNodeCIDRAggregatorRemoveNodeShrinksSet(c *C) {
+	agg := NewNodeCIDRAggregator()
+	a := &Node{Name: "a", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.0.0/24")}
+	b := &Node{Name: "b", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.5.0/24")}
+	agg.AddNode(a)
+	agg.AddNode(b)
+
+	var calls []cidrAggregatorCall
+	agg.Subscribe(func(added, removed []*cidr.CIDR) {
+		calls = append(calls, cidrAggregatorCall{cidrNames(added), cidrNames(removed)})
+	})
+
+	agg.RemoveNode(a)
+
+	c.Assert(cidrSet(c, agg), DeepEquals, []string{"10.0.5.0/24"})
+	c.Assert(calls, HasLen, 1)
+	c.Assert(calls[0].added, HasLen, 0)
+	c.Assert(calls[0].removed, DeepEquals, []string{"10.0.0.0/24"})
+}
+
+func (s *NodeSuite) TestNodeCIDRAggregatorRemoveSharedCIDRIsNoop(c *C) {
+	agg := NewNodeCIDRAggregator()
+	a := &Node{Name: "a", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.0.0/24")}
+	b := &Node{Name: "b", IPv4AllocCIDR: cidr.MustParseCIDR("10.0.0.0/24")}
+	agg.AddNode(a)
+	agg.AddNode(b)
+
+	calls := 0
+	agg.Subscribe(func(added, removed []*cidr.CIDR) { calls++ })
+
+	// b still owns the same /24, so removing a must not retract coverage.
+	agg.RemoveNode(a)
+
+	c.Assert(cidrSet(c, agg), DeepEquals, []string{"10.0.0.0/24"})
+	c.Assert(calls, Equals, 0)
+}
@@ -0,0 +1,396 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cilium/cilium/pkg/cidr"
+	ciliumv2 "github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/node/addressing"
+	"github.com/cilium/cilium/pkg/source"
+)
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "node")
+
+// Node contains the nodes name, the subnets that the node is reachable
+// through, and its IP addresses.
+type Node struct {
+	// Name is the name of the node. This is typically the hostname of
+	// the node.
+	Name string
+
+	// Cluster is the name of the cluster the node is part of
+	Cluster string
+
+	IPAddresses []Address
+
+	// IPv4AllocCIDR if set, is the IPv4 allocation CIDR that was
+	// configured for the node.
+	IPv4AllocCIDR *cidr.CIDR
+
+	// IPv4SecondaryAllocCIDRs contains additional IPv4 CIDRs from which
+	// to allocate pod IPs besides IPv4AllocCIDR, e.g. for clusters that
+	// advertise more than one pod CIDR per node (dual-stack, secondary
+	// ranges).
+	IPv4SecondaryAllocCIDRs []*cidr.CIDR
+
+	// IPv6AllocCIDR if set, is the IPv6 allocation CIDR that was
+	// configured for the node.
+	IPv6AllocCIDR *cidr.CIDR
+
+	// IPv6SecondaryAllocCIDRs contains additional IPv6 CIDRs from which
+	// to allocate pod IPs besides IPv6AllocCIDR.
+	IPv6SecondaryAllocCIDRs []*cidr.CIDR
+
+	// IPv4HealthIP if not nil, this is the IPv4 address of the
+	// cilium-health endpoint located on the node.
+	IPv4HealthIP net.IP
+
+	// IPv6HealthIP if not nil, this is the IPv6 address of the
+	// cilium-health endpoint located on the node.
+	IPv6HealthIP net.IP
+
+	// ClusterID is the unique identifier of the cluster
+	ClusterID int
+
+	// Source is the source where the node configuration was generated / created.
+	Source source.Source
+
+	// EncryptionKey is the index to the encryption key to use for
+	// encryption, or 0 if encryption is disabled
+	EncryptionKey uint8
+
+	// WireguardPubKey is the base64-encoded WireGuard public key
+	// advertised by the node, or empty if WireGuard is disabled.
+	WireguardPubKey string
+}
+
+// Address is a node address which contains an IP and the type of the IP
+// (CiliumInternalIP, NodeInternalIP or NodeExternalIP).
+type Address struct {
+	Type addressing.AddressType
+	IP   net.IP
+}
+
+// GetNodeIP returns one of the node's IP addresses available with the
+// following priority:
+// - NodeInternalIP
+// - NodeExternalIP
+// - other IP address type
+// An IPv4 or IPv6 address is returned depending on the ipv6 parameter.
+func (n *Node) GetNodeIP(ipv6 bool) net.IP {
+	var backupIP net.IP
+	for _, addr := range n.IPAddresses {
+		if (addr.IP.To4() != nil) == ipv6 {
+			continue
+		}
+		switch addr.Type {
+		// Always prefer a cluster internal IP
+		case addressing.NodeInternalIP:
+			return addr.IP
+		case addressing.NodeExternalIP:
+			// Fall back to external Node IP
+			// if no internal IP could be found
+			backupIP = addr.IP
+		default:
+			// As a last resort, if no internal or external
+			// IP was found, use any node address available
+			if backupIP == nil {
+				backupIP = addr.IP
+			}
+		}
+	}
+	return backupIP
+}
+
+// IPFamily represents the address family (or combination of address
+// families) that a Node is configured for.
+type IPFamily int
+
+const (
+	// Invalid is returned when a node's configuration is internally
+	// inconsistent, e.g. it has an IPv4 allocation CIDR but no IPv4
+	// addresses.
+	Invalid IPFamily = iota
+	// IPv4 is returned when the node is configured for IPv4 only.
+	IPv4
+	// IPv6 is returned when the node is configured for IPv6 only.
+	IPv6
+	// DualStack is returned when the node is configured for both IPv4
+	// and IPv6.
+	DualStack
+)
+
+func (f IPFamily) String() string {
+	switch f {
+	case IPv4:
+		return "IPv4"
+	case IPv6:
+		return "IPv6"
+	case DualStack:
+		return "DualStack"
+	default:
+		return "Invalid"
+	}
+}
+
+// hasV4Addr/hasV6Addr report whether ip is a non-nil IPv4/IPv6 address.
+func hasV4Addr(ip net.IP) bool { return ip != nil && ip.To4() != nil }
+func hasV6Addr(ip net.IP) bool { return ip != nil && ip.To4() == nil }
+
+// GetIPFamily examines the node's IPAddresses, alloc CIDRs, and health IPs
+// to classify it as IPv4, IPv6, or DualStack. It returns an error if the
+// signals are inconsistent, e.g. an IPv4 allocation CIDR is set but the
+// node has no IPv4 address of any kind.
+func (n *Node) GetIPFamily() (IPFamily, error) {
+	var v4, v6 bool
+
+	for _, addr := range n.IPAddresses {
+		if hasV4Addr(addr.IP) {
+			v4 = true
+		}
+		if hasV6Addr(addr.IP) {
+			v6 = true
+		}
+	}
+	if hasV4Addr(n.IPv4HealthIP) {
+		v4 = true
+	}
+	if hasV6Addr(n.IPv6HealthIP) {
+		v6 = true
+	}
+
+	if n.IPv4AllocCIDR != nil && !v4 {
+		return Invalid, fmt.Errorf("node %s has an IPv4 allocation CIDR %s but no IPv4 address", n.Name, n.IPv4AllocCIDR)
+	}
+	if n.IPv6AllocCIDR != nil && !v6 {
+		return Invalid, fmt.Errorf("node %s has an IPv6 allocation CIDR %s but no IPv6 address", n.Name, n.IPv6AllocCIDR)
+	}
+
+	switch {
+	case v4 && v6:
+		return DualStack, nil
+	case v4:
+		return IPv4, nil
+	case v6:
+		return IPv6, nil
+	default:
+		return Invalid, fmt.Errorf("node %s has no usable IPv4 or IPv6 address", n.Name)
+	}
+}
+
+// GetNodeIPByFamily returns the node's IP address for the given family. It
+// supersedes GetNodeIP's boolean parameter for callers that already work in
+// terms of IPFamily. DualStack and Invalid are not valid inputs and always
+// return nil.
+func (n *Node) GetNodeIPByFamily(family IPFamily) net.IP {
+	switch family {
+	case IPv4:
+		return n.GetNodeIP(false)
+	case IPv6:
+		return n.GetNodeIP(true)
+	default:
+		return nil
+	}
+}
+
+// AllIPv4AllocCIDRs returns every IPv4 allocation CIDR owned by the node,
+// starting with the primary IPv4AllocCIDR (if set) followed by
+// IPv4SecondaryAllocCIDRs in order. Callers must not mutate the returned
+// slice.
+func (n *Node) AllIPv4AllocCIDRs() []*cidr.CIDR {
+	if n.IPv4AllocCIDR == nil {
+		return n.IPv4SecondaryAllocCIDRs
+	}
+	all := make([]*cidr.CIDR, 0, len(n.IPv4SecondaryAllocCIDRs)+1)
+	all = append(all, n.IPv4AllocCIDR)
+	return append(all, n.IPv4SecondaryAllocCIDRs...)
+}
+
+// AllIPv6AllocCIDRs returns every IPv6 allocation CIDR owned by the node,
+// starting with the primary IPv6AllocCIDR (if set) followed by
+// IPv6SecondaryAllocCIDRs in order. Callers must not mutate the returned
+// slice.
+func (n *Node) AllIPv6AllocCIDRs() []*cidr.CIDR {
+	if n.IPv6AllocCIDR == nil {
+		return n.IPv6SecondaryAllocCIDRs
+	}
+	all := make([]*cidr.CIDR, 0, len(n.IPv6SecondaryAllocCIDRs)+1)
+	all = append(all, n.IPv6AllocCIDR)
+	return append(all, n.IPv6SecondaryAllocCIDRs...)
+}
+
+// cidrsEqual returns true if a and b contain the same set of CIDRs,
+// irrespective of order.
+func cidrsEqual(a, b []*cidr.CIDR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	remaining := make([]*cidr.CIDR, len(b))
+	copy(remaining, b)
+	for _, ca := range a {
+		found := false
+		for i, cb := range remaining {
+			if (ca == nil) != (cb == nil) {
+				continue
+			}
+			if ca == nil || ca.String() == cb.String() {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// PublicAttrEquals returns true if both nodes are identical in public
+// attributes, i.e. the attributes that are not related to the node's
+// internal bookkeeping. This is used to determine whether a change in a
+// Node object requires downstream consumers to be notified.
+func (n *Node) PublicAttrEquals(o *Node) bool {
+	if o == nil {
+		return false
+	}
+
+	if n.Name != o.Name ||
+		n.Cluster != o.Cluster ||
+		n.ClusterID != o.ClusterID ||
+		n.Source != o.Source ||
+		n.EncryptionKey != o.EncryptionKey ||
+		n.WireguardPubKey != o.WireguardPubKey {
+		return false
+	}
+
+	if (n.IPv4AllocCIDR != nil) != (o.IPv4AllocCIDR != nil) {
+		return false
+	}
+	if n.IPv4AllocCIDR != nil && n.IPv4AllocCIDR.String() != o.IPv4AllocCIDR.String() {
+		return false
+	}
+
+	if (n.IPv6AllocCIDR != nil) != (o.IPv6AllocCIDR != nil) {
+		return false
+	}
+	if n.IPv6AllocCIDR != nil && n.IPv6AllocCIDR.String() != o.IPv6AllocCIDR.String() {
+		return false
+	}
+
+	if !cidrsEqual(n.IPv4SecondaryAllocCIDRs, o.IPv4SecondaryAllocCIDRs) {
+		return false
+	}
+	if !cidrsEqual(n.IPv6SecondaryAllocCIDRs, o.IPv6SecondaryAllocCIDRs) {
+		return false
+	}
+
+	if len(n.IPAddresses) != len(o.IPAddresses) {
+		return false
+	}
+
+	for i, addr := range n.IPAddresses {
+		oAddr := o.IPAddresses[i]
+		if !addr.IP.Equal(oAddr.IP) || addr.Type != oAddr.Type {
+			return false
+		}
+	}
+
+	if !n.IPv4HealthIP.Equal(o.IPv4HealthIP) || !n.IPv6HealthIP.Equal(o.IPv6HealthIP) {
+		return false
+	}
+
+	return true
+}
+
+// String returns the most useful human readable representation of the node
+func (n *Node) String() string {
+	if n == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%s/%s", n.Cluster, n.Name)
+}
+
+// parsePodCIDRs splits the given list of CIDR strings by address family,
+// returning the primary CIDR for each family (the first one encountered)
+// plus every additional CIDR of that family as secondaries. Malformed
+// entries are skipped.
+func parsePodCIDRs(podCIDRs []string) (v4Primary *cidr.CIDR, v4Secondary []*cidr.CIDR, v6Primary *cidr.CIDR, v6Secondary []*cidr.CIDR) {
+	for _, ciliumInternalIPStr := range podCIDRs {
+		c, err := cidr.ParseCIDR(ciliumInternalIPStr)
+		if err != nil {
+			continue
+		}
+		if c.IP.To4() != nil {
+			if v4Primary == nil {
+				v4Primary = c
+			} else {
+				v4Secondary = append(v4Secondary, c)
+			}
+		} else {
+			if v6Primary == nil {
+				v6Primary = c
+			} else {
+				v6Secondary = append(v6Secondary, c)
+			}
+		}
+	}
+	return
+}
+
+// ParseCiliumNode parses a CiliumNode custom resource and converts it to a
+// Node. Fields left unset by Spec are supplemented from well-known
+// annotations (and, failing that, labels) via ParseNodeFromAnnotations;
+// Spec always takes precedence over an annotation/label with the same
+// meaning. Malformed annotation values are logged and otherwise ignored,
+// never cause ParseCiliumNode itself to fail.
+func ParseCiliumNode(n *ciliumv2.CiliumNode) (node Node) {
+	node = Node{
+		Name:          n.Name,
+		Source:        source.CustomResource,
+		EncryptionKey: uint8(n.Spec.Encryption.Key),
+	}
+
+	node.IPv4AllocCIDR, node.IPv4SecondaryAllocCIDRs, node.IPv6AllocCIDR, node.IPv6SecondaryAllocCIDRs =
+		parsePodCIDRs(n.Spec.IPAM.PodCIDRs)
+
+	if n.Spec.HealthAddressing.IPv4 != "" {
+		node.IPv4HealthIP = net.ParseIP(n.Spec.HealthAddressing.IPv4)
+	}
+	if n.Spec.HealthAddressing.IPv6 != "" {
+		node.IPv6HealthIP = net.ParseIP(n.Spec.HealthAddressing.IPv6)
+	}
+
+	for _, address := range n.Spec.Addresses {
+		ip := net.ParseIP(address.IP)
+		if ip == nil {
+			continue
+		}
+		node.IPAddresses = append(node.IPAddresses, Address{Type: address.Type, IP: ip})
+	}
+
+	fromAnnotations, errs := ParseNodeFromAnnotations(n.ObjectMeta)
+	for _, err := range errs {
+		log.WithError(err).WithField(logfields.NodeName, n.Name).Warning("Ignoring malformed node annotation")
+	}
+	node = mergeAnnotations(node, fromAnnotations)
+
+	return
+}
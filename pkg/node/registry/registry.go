@@ -0,0 +1,165 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package registry implements a reverse lookup index that answers "which
+// node owns this IP?" in O(prefix length) time. It is backed by a bitwise
+// radix trie per address family, modeled on the Tree4/Tree6 design used by
+// Nebula's routing table.
+package registry
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/cilium/cilium/pkg/cidr"
+	"github.com/cilium/cilium/pkg/node"
+)
+
+// Registry is a longest-prefix-match index from CIDR to *node.Node, with
+// one trie per address family. It is safe for concurrent use.
+type Registry struct {
+	mu sync.RWMutex
+	v4 *bitTrie
+	v6 *bitTrie
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		v4: newBitTrie(32),
+		v6: newBitTrie(128),
+	}
+}
+
+func treeKey(c *cidr.CIDR) (ip net.IP, ones int, isV4 bool, err error) {
+	if c == nil || c.IPNet == nil {
+		return nil, 0, false, fmt.Errorf("nil CIDR")
+	}
+	ones, bits := c.Mask.Size()
+	if v4 := c.IP.To4(); v4 != nil {
+		return v4, ones, true, nil
+	}
+	if bits != 128 {
+		return nil, 0, false, fmt.Errorf("unexpected CIDR bit length %d", bits)
+	}
+	return c.IP.To16(), ones, false, nil
+}
+
+// Insert indexes every allocation CIDR owned by n (primary and secondary,
+// both families) against n.
+func (r *Registry) Insert(n *node.Node) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range n.AllIPv4AllocCIDRs() {
+		if ip, ones, _, err := treeKey(c); err == nil {
+			r.v4.Insert(ip, ones, n)
+		}
+	}
+	for _, c := range n.AllIPv6AllocCIDRs() {
+		if ip, ones, _, err := treeKey(c); err == nil {
+			r.v6.Insert(ip, ones, n)
+		}
+	}
+}
+
+// Delete removes every allocation CIDR owned by n from the index.
+func (r *Registry) Delete(n *node.Node) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range n.AllIPv4AllocCIDRs() {
+		if ip, ones, _, err := treeKey(c); err == nil {
+			r.v4.Delete(ip, ones)
+		}
+	}
+	for _, c := range n.AllIPv6AllocCIDRs() {
+		if ip, ones, _, err := treeKey(c); err == nil {
+			r.v6.Delete(ip, ones)
+		}
+	}
+}
+
+// Update re-indexes a node whose PublicAttrEquals has changed, e.g. after a
+// CIDR was added, removed, or reassigned. Callers should call this instead
+// of a bare Insert whenever the node's previous CIDR set is known, so that
+// CIDRs no longer owned by the node are dropped from the index.
+func (r *Registry) Update(old, new *node.Node) {
+	if old != nil {
+		r.Delete(old)
+	}
+	if new != nil {
+		r.Insert(new)
+	}
+}
+
+// Lookup returns the node whose allocation CIDR is the longest prefix match
+// for ip, the matched CIDR, and whether a match was found.
+func (r *Registry) Lookup(ip net.IP) (*node.Node, *cidr.CIDR, bool) {
+	if ip == nil {
+		return nil, nil, false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var (
+		value interface{}
+		ones  int
+		ok    bool
+	)
+	if v4 := ip.To4(); v4 != nil {
+		value, ones, ok = r.v4.Lookup(v4)
+		if ok {
+			return value.(*node.Node), cidr.NewCIDR(&net.IPNet{IP: v4.Mask(net.CIDRMask(ones, 32)), Mask: net.CIDRMask(ones, 32)}), true
+		}
+		return nil, nil, false
+	}
+
+	v6 := ip.To16()
+	if v6 == nil {
+		// ip is neither a valid 4-byte nor 16-byte address.
+		return nil, nil, false
+	}
+	value, ones, ok = r.v6.Lookup(v6)
+	if !ok {
+		return nil, nil, false
+	}
+	return value.(*node.Node), cidr.NewCIDR(&net.IPNet{IP: v6.Mask(net.CIDRMask(ones, 128)), Mask: net.CIDRMask(ones, 128)}), true
+}
+
+// Contains reports whether ip is covered by any indexed allocation CIDR.
+func (r *Registry) Contains(ip net.IP) bool {
+	_, _, ok := r.Lookup(ip)
+	return ok
+}
+
+// defaultRegistry is the package-level Registry used by the package-level
+// Lookup helper below.
+var defaultRegistry = NewRegistry()
+
+// Default returns the package-level Registry shared by all callers that do
+// not need an isolated instance (e.g. for testing).
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// Lookup is a convenience wrapper around Default().Lookup that returns just
+// the owning node, for callers (encryption key selection, tunnel endpoint
+// resolution, health checks) that only care which node owns ip.
+func Lookup(ip net.IP) *node.Node {
+	n, _, _ := defaultRegistry.Lookup(ip)
+	return n
+}
@@ -0,0 +1,106 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !privileged_tests
+
+package registry
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/cilium/cilium/pkg/cidr"
+	"github.com/cilium/cilium/pkg/node"
+)
+
+func mustNode(name, cidrStr string) *node.Node {
+	return &node.Node{Name: name, IPv4AllocCIDR: cidr.MustParseCIDR(cidrStr)}
+}
+
+func TestLookupOverlappingPrefixes(t *testing.T) {
+	r := NewRegistry()
+	broad := mustNode("broad", "10.0.0.0/8")
+	narrow := mustNode("narrow", "10.1.0.0/16")
+	r.Insert(broad)
+	r.Insert(narrow)
+
+	n, c, ok := r.Lookup(net.ParseIP("10.1.2.3"))
+	if !ok || n.Name != "narrow" || c.String() != "10.1.0.0/16" {
+		t.Fatalf("expected longest-match narrow, got %+v %v %v", n, c, ok)
+	}
+
+	n, _, ok = r.Lookup(net.ParseIP("10.2.0.1"))
+	if !ok || n.Name != "broad" {
+		t.Fatalf("expected fallback to broad, got %+v %v", n, ok)
+	}
+
+	if r.Contains(net.ParseIP("11.0.0.1")) {
+		t.Fatal("expected no match outside of indexed CIDRs")
+	}
+}
+
+func TestLookupIPv4MappedIPv6(t *testing.T) {
+	r := NewRegistry()
+	r.Insert(mustNode("v4", "192.0.2.0/24"))
+
+	n, _, ok := r.Lookup(net.ParseIP("::ffff:192.0.2.5"))
+	if !ok || n.Name != "v4" {
+		t.Fatalf("expected IPv4-mapped IPv6 address to match the IPv4 trie, got %+v %v", n, ok)
+	}
+}
+
+func TestLookupNilIP(t *testing.T) {
+	r := NewRegistry()
+	r.Insert(mustNode("v4", "192.0.2.0/24"))
+
+	// net.ParseIP returns nil for a malformed address; Lookup must
+	// report no match rather than panic.
+	if n, c, ok := r.Lookup(net.ParseIP("not-an-ip")); ok {
+		t.Fatalf("expected no match for nil IP, got %+v %v", n, c)
+	}
+	if r.Contains(nil) {
+		t.Fatal("expected Contains(nil) to be false")
+	}
+}
+
+func TestDeleteRemovesMatch(t *testing.T) {
+	r := NewRegistry()
+	n := mustNode("gone", "172.16.0.0/16")
+	r.Insert(n)
+	r.Delete(n)
+
+	if r.Contains(net.ParseIP("172.16.5.5")) {
+		t.Fatal("expected no match after delete")
+	}
+}
+
+func TestConcurrentChurn(t *testing.T) {
+	r := NewRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := mustNode("churn", "10.50.0.0/24")
+			r.Insert(n)
+			r.Lookup(net.ParseIP("10.50.0.1"))
+			if i%2 == 0 {
+				r.Delete(n)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,58 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+
+	"github.com/cilium/cilium/pkg/node"
+	"github.com/cilium/cilium/pkg/node/table"
+	"github.com/cilium/cilium/pkg/statedb"
+)
+
+// SyncFromTable subscribes to tbl's change stream and keeps r up to date:
+// every insert indexes the new node, every update re-indexes it via Update
+// (so CIDRs no longer owned by the node are dropped, per PublicAttrEquals),
+// and every delete removes it. It returns once the subscription is
+// established; consumption happens in a background goroutine that exits
+// when ctx is cancelled.
+func (r *Registry) SyncFromTable(ctx context.Context, db *statedb.DB, tbl statedb.Table[*node.Node]) error {
+	changes, err := table.Changes(ctx, db, tbl)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for ev := range changes {
+			switch ev.Kind {
+			case table.EventInsert:
+				r.Insert(ev.New)
+			case table.EventUpdate:
+				r.Update(ev.Old, ev.New)
+			case table.EventDelete:
+				r.Delete(ev.Old)
+			}
+		}
+	}()
+	return nil
+}
+
+// SyncDefaultFromTable wires the package-level Default registry (and hence
+// the package-level Lookup helper) to tbl's change stream. Call this once
+// during startup, e.g. alongside the table's own registration, so that
+// Lookup reflects every node known to tbl.
+func SyncDefaultFromTable(ctx context.Context, db *statedb.DB, tbl statedb.Table[*node.Node]) error {
+	return defaultRegistry.SyncFromTable(ctx, db, tbl)
+}
@@ -0,0 +1,107 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import "net"
+
+// trieNode is a single node of a bitwise radix trie. A value is stored on
+// the interior node at which its prefix terminates, so that a descent from
+// the root which remembers the last node carrying a value performs a
+// longest-prefix match in a single pass.
+type trieNode struct {
+	left, right *trieNode
+	hasValue    bool
+	value       interface{}
+}
+
+// bitTrie is a binary radix trie keyed by the first maxBits bits of an IP
+// address. It is not safe for concurrent use; callers serialize access
+// (see Registry).
+type bitTrie struct {
+	root    *trieNode
+	maxBits int
+}
+
+func newBitTrie(maxBits int) *bitTrie {
+	return &bitTrie{root: &trieNode{}, maxBits: maxBits}
+}
+
+// bit returns the i-th most-significant bit (0-indexed) of ip.
+func bit(ip net.IP, i int) byte {
+	return (ip[i/8] >> uint(7-i%8)) & 1
+}
+
+// Insert stores value for the prefix described by ip/ones bits of ip.
+func (t *bitTrie) Insert(ip net.IP, ones int, value interface{}) {
+	n := t.root
+	for i := 0; i < ones; i++ {
+		if bit(ip, i) == 0 {
+			if n.left == nil {
+				n.left = &trieNode{}
+			}
+			n = n.left
+		} else {
+			if n.right == nil {
+				n.right = &trieNode{}
+			}
+			n = n.right
+		}
+	}
+	n.hasValue = true
+	n.value = value
+}
+
+// Delete removes the value stored for the exact prefix ip/ones, if any.
+func (t *bitTrie) Delete(ip net.IP, ones int) {
+	n := t.root
+	for i := 0; i < ones; i++ {
+		if bit(ip, i) == 0 {
+			if n.left == nil {
+				return
+			}
+			n = n.left
+		} else {
+			if n.right == nil {
+				return
+			}
+			n = n.right
+		}
+	}
+	n.hasValue = false
+	n.value = nil
+}
+
+// Lookup performs a longest-prefix match for ip, returning the value stored
+// at the deepest matching prefix along with the number of bits matched.
+func (t *bitTrie) Lookup(ip net.IP) (value interface{}, matchedBits int, ok bool) {
+	n := t.root
+	if n.hasValue {
+		value, matchedBits, ok = n.value, 0, true
+	}
+	for i := 0; i < t.maxBits; i++ {
+		if bit(ip, i) == 0 {
+			n = n.left
+		} else {
+			n = n.right
+		}
+		if n == nil {
+			break
+		}
+		if n.hasValue {
+			value, matchedBits, ok = n.value, i+1, true
+		}
+	}
+	return
+}
@@ -0,0 +1,96 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package table
+
+import (
+	"context"
+
+	"github.com/cilium/cilium/pkg/node"
+	"github.com/cilium/cilium/pkg/statedb"
+)
+
+// EventKind describes what happened to a Node row.
+type EventKind int
+
+const (
+	EventInsert EventKind = iota
+	EventUpdate
+	EventDelete
+)
+
+// Event is a single insert/update/delete observed on the node table. Old is
+// nil for EventInsert, New is nil for EventDelete.
+type Event struct {
+	Kind EventKind
+	Old  *node.Node
+	New  *node.Node
+}
+
+// Changes returns an observable of every insert/update/delete applied to
+// tbl from this point on. The returned channel is closed when ctx is
+// cancelled. Unlike statedb's raw change iterator, Event carries both the
+// old and new value so subscribers (ipcache, encryption, health) can diff
+// exactly what changed instead of re-scanning the table; PublicAttrEquals
+// is used as the predicate deciding whether a replacing write is an
+// externally visible EventUpdate or a no-op that isn't surfaced at all.
+func Changes(ctx context.Context, db *statedb.DB, tbl statedb.Table[*node.Node]) (<-chan Event, error) {
+	txn := db.ReadTxn()
+	it, err := tbl.Changes(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+
+		seen := map[string]*node.Node{}
+		for {
+			changes, watch := it.Next(db.ReadTxn())
+			for _, c := range changes {
+				key := c.Object.Cluster + "/" + c.Object.Name
+				old, hadOld := seen[key]
+
+				var ev Event
+				switch {
+				case c.Deleted:
+					ev = Event{Kind: EventDelete, Old: c.Object, New: nil}
+					delete(seen, key)
+				case !hadOld:
+					ev = Event{Kind: EventInsert, Old: nil, New: c.Object}
+					seen[key] = c.Object
+				case old.PublicAttrEquals(c.Object):
+					seen[key] = c.Object
+					continue
+				default:
+					ev = Event{Kind: EventUpdate, Old: old, New: c.Object}
+					seen[key] = c.Object
+				}
+
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-watch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
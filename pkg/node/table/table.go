@@ -0,0 +1,119 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package table stores Node objects in a statedb.Table, following the
+// pattern used by pkg/datapath/tables for node addresses. It replaces the
+// ad-hoc NodeManager callback fan-out with snapshot reads, watch-with-
+// revision, and typed change events that consumers (ipcache, encryption,
+// health) can subscribe to without re-scanning the whole node set.
+package table
+
+import (
+	"net"
+
+	"github.com/cilium/cilium/pkg/node"
+	"github.com/cilium/cilium/pkg/statedb"
+	"github.com/cilium/cilium/pkg/statedb/index"
+)
+
+const TableName = "nodes"
+
+var (
+	// ClusterNameIndex is the primary key: a Node's fully-qualified
+	// "<cluster>/<name>". Bare Name alone is not unique across a
+	// clustermesh, where two different clusters may each have a node
+	// named "foo".
+	ClusterNameIndex = statedb.Index[*node.Node, string]{
+		Name: "cluster-name",
+		FromObject: func(n *node.Node) index.KeySet {
+			return index.NewKeySet(index.String(n.Cluster + "/" + n.Name))
+		},
+		FromKey: index.String,
+		Unique:  true,
+	}
+
+	// NameIndex looks up every Node with a given bare name, which may
+	// span multiple clusters. It is non-unique for that reason; callers
+	// that need a single node should use ClusterNameIndex instead.
+	NameIndex = statedb.Index[*node.Node, string]{
+		Name: "name",
+		FromObject: func(n *node.Node) index.KeySet {
+			return index.NewKeySet(index.String(n.Name))
+		},
+		FromKey: index.String,
+		Unique:  false,
+	}
+
+	// IPAddressIndex looks up the Node(s) that own a given IP. It is
+	// non-unique: nothing prevents two nodes from (erroneously)
+	// advertising the same address, and callers that care about that
+	// should inspect every match.
+	IPAddressIndex = statedb.Index[*node.Node, net.IP]{
+		Name: "ip-address",
+		FromObject: func(n *node.Node) index.KeySet {
+			keys := make([]index.Key, 0, len(n.IPAddresses))
+			for _, addr := range n.IPAddresses {
+				keys = append(keys, index.NetIP(addr.IP))
+			}
+			return index.NewKeySet(keys...)
+		},
+		FromKey: index.NetIP,
+		Unique:  false,
+	}
+)
+
+// NewTable constructs the *node.Node statedb table and registers it with
+// db. Nodes, e.g. as returned by ParseCiliumNode, are written into the
+// returned table with Upsert and Delete; ParseCiliumNode itself does not
+// write to it. Other subsystems should acquire their own read-only handle via
+// db.ReadTable(TableName) or an injected statedb.Table[*node.Node].
+func NewTable(db *statedb.DB) (statedb.RWTable[*node.Node], error) {
+	tbl, err := statedb.NewTable(TableName, ClusterNameIndex, NameIndex, IPAddressIndex)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.RegisterTable(tbl); err != nil {
+		return nil, err
+	}
+	return tbl, nil
+}
+
+// Upsert inserts n, or replaces the existing row with the same
+// ClusterNameIndex key if PublicAttrEquals reports a change. It is a no-op
+// if an identical row is already present, so callers can call it
+// unconditionally from the k8s informer's AddFunc/UpdateFunc.
+func Upsert(db *statedb.DB, tbl statedb.RWTable[*node.Node], n *node.Node) error {
+	txn := db.WriteTxn(tbl)
+	defer txn.Abort()
+
+	if old, _, found := tbl.First(txn, ClusterNameIndex.Query(n.Cluster+"/"+n.Name)); found && old.PublicAttrEquals(n) {
+		return nil
+	}
+
+	if _, _, err := tbl.Insert(txn, n); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// Delete removes the row for n, identified by its ClusterNameIndex key.
+func Delete(db *statedb.DB, tbl statedb.RWTable[*node.Node], n *node.Node) error {
+	txn := db.WriteTxn(tbl)
+	defer txn.Abort()
+
+	if _, _, err := tbl.Delete(txn, n); err != nil {
+		return err
+	}
+	return txn.Commit()
+}